@@ -1,7 +1,9 @@
 package router
 
 import (
+	"context"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
@@ -42,28 +44,177 @@ var verbs = map[string]Verb{
 	"PUT":     Put,
 }
 
+// verbNames is the inverse of verbs, used to build the Allow header.
+var verbNames = [unknownVerb]string{
+	Delete:  "DELETE",
+	Get:     "GET",
+	Head:    "HEAD",
+	Options: "OPTIONS",
+	Patch:   "PATCH",
+	Post:    "POST",
+	Put:     "PUT",
+}
+
 // Handler instances are just request handler functions
 type Handler func(http.ResponseWriter, *http.Request, []string)
 
+// Middleware wraps a Handler to produce a new Handler, letting cross-cutting
+// concerns (logging, auth, CORS, recovery, ...) be composed around route
+// handlers without rewriting each one.
+type Middleware func(Handler) Handler
+
 // Builder allows the creation of an immutable router so locking can be avoided
 // at serving time.
 type Builder interface {
 	Handle(Verb, string, Handler)
 	HandleAll(string, Handler)
+
+	// Use appends middleware to this builder's stack. It is applied, in the
+	// order given, to every route registered afterward on this builder or on
+	// any Group derived from it.
+	Use(...Middleware)
+
+	// Group creates a scoped Builder with the given prefix prepended to every
+	// route it registers. The group inherits its parent's middleware stack at
+	// the time Group is called and may layer on its own via Use.
+	Group(string, func(Builder))
+
+	// RedirectCleanPath, when enabled, makes the router respond with a 301
+	// redirect to the cleaned form of a path (see CleanPath) when the raw
+	// path doesn't match a route but its cleaned form does.
+	RedirectCleanPath(bool)
+
+	// RedirectTrailingSlash, when enabled, makes the router respond with a
+	// 301 redirect to a path with its trailing slash added or removed, when
+	// the requested path doesn't match a route but its counterpart does.
+	RedirectTrailingSlash(bool)
+
+	// AddRegex constrains every ":name" segment registered from here on to
+	// match pattern. When it doesn't, matching falls back to an unconstrained
+	// wildcard or a "**" catch-all (if any), and otherwise the segment matches
+	// no route. name may be given with or without its leading
+	// ":". It panics if pattern does not compile. int, uuid, and slug are
+	// pre-registered built-ins.
+	AddRegex(name, pattern string)
+
+	// AutoOptions, when enabled, makes the router respond to an OPTIONS
+	// request for any matched route with a 204 and a computed Allow header,
+	// unless an OPTIONS handler was explicitly registered for that route.
+	AutoOptions(bool)
+
+	// SendAllowHeader, when enabled, populates the Allow header with the
+	// verbs registered on a matched route whenever it responds 405 for an
+	// unregistered verb.
+	SendAllowHeader(bool)
+
 	Build() http.Handler
 }
 
+// Route describes a single registered verb/pattern pair, as reported by
+// Routes.Walk.
+type Route struct {
+	Verb    Verb
+	Pattern string
+}
+
+// Routes is implemented by the http.Handler returned from Build, letting
+// callers enumerate every route registered on it, e.g. for a debug endpoint
+// or a startup route table.
+type Routes interface {
+	http.Handler
+	Walk(func(Route) error) error
+}
+
 type router struct {
 	// The child nodes underneath this node.
 	ch map[string]*router
 	rt *route
+
+	// pn is the parameter name captured by this node, when it was placed
+	// from a ":name" segment rather than a bare "*"/"*/" wildcard.
+	pn string
+
+	// reCh holds the regex-constrained children of this node, tried in
+	// registration order before falling back to the unconstrained wildcard.
+	reCh []*regexChild
+
+	// rcp and rts mirror Builder.RedirectCleanPath/RedirectTrailingSlash.
+	// ao and sah mirror Builder.AutoOptions/SendAllowHeader. All four are
+	// only meaningful on the root node.
+	rcp bool
+	rts bool
+	ao  bool
+	sah bool
+
+	// constraints maps a parameter name to the regex it must match. It is
+	// only meaningful on the root node.
+	constraints map[string]*regexp.Regexp
+}
+
+// regexChild is a ":name" child constrained to match re, kept distinct from
+// the unconstrained "*"/"*/" wildcard child.
+type regexChild struct {
+	name          string
+	trailingSlash bool
+	re            *regexp.Regexp
+	node          *router
+}
+
+// addConstraint registers name (with or without a leading ":") as requiring
+// pattern. It panics if pattern does not compile.
+func (r *router) addConstraint(name, pattern string) {
+	if r.constraints == nil {
+		r.constraints = map[string]*regexp.Regexp{}
+	}
+	r.constraints[strings.TrimPrefix(name, ":")] = regexp.MustCompile("^(?:" + pattern + ")$")
+}
+
+type paramsKey struct{}
+
+// Param returns the value captured for the named path parameter in req, as
+// registered with a ":name" segment. It returns "" if no such parameter was
+// captured, either because the route has no named parameters or name does
+// not match any of them.
+func Param(r *http.Request, name string) string {
+	m, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return m[name]
+}
+
+// namedParam reports whether k is a ":name" segment (with an optional
+// trailing slash) and, if so, returns the parameter name.
+func namedParam(k string) (string, bool) {
+	body := strings.TrimSuffix(k, "/")
+	if len(body) > 1 && body[0] == ':' {
+		return body[1:], true
+	}
+	return "", false
 }
 
 type route struct {
 	vb [unknownVerb]Handler
+
+	// mw is the middleware stack captured at registration time for each
+	// verb, applied to vb by Build.
+	mw [unknownVerb][]Middleware
+
+	// pattern is the original route pattern, as passed to Handle/HandleAll,
+	// reported by Walk.
+	pattern string
 }
 
-func (r *router) place(path string) *router {
+// allow returns the comma-separated, Allow-header-ready list of verbs
+// registered on rt.
+func (rt *route) allow() string {
+	var names []string
+	for i, h := range rt.vb {
+		if h != nil {
+			names = append(names, verbNames[i])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func (r *router) place(path string, constraints map[string]*regexp.Regexp) *router {
 	if path == "" {
 		return r
 	}
@@ -78,16 +229,73 @@ func (r *router) place(path string) *router {
 		k = path[:ix+1]
 	}
 
+	// "**" is a terminal catch-all: it consumes the rest of the path,
+	// slashes included, as a single name, so it is not allowed to have
+	// anything registered after it.
+	if strings.TrimSuffix(k, "/") == "**" {
+		if ix >= 0 {
+			panic(`router: "**" must be the final segment of a route`)
+		}
+
+		ch := r.ch["**"]
+		if ch == nil {
+			ch = &router{}
+			r.ch["**"] = ch
+		}
+		return ch
+	}
+
+	// A ":name" segment is placed the same as a "*"/"*/" wildcard, but the
+	// node also records the parameter name so find can pair it with the
+	// captured value. If name has a registered regex constraint, it is
+	// placed as a regexChild instead, so it can be tried ahead of (and
+	// fall back to) the unconstrained wildcard.
+	if name, ok := namedParam(k); ok {
+		trailingSlash := k[len(k)-1] == '/'
+
+		if re, ok := constraints[name]; ok {
+			for _, rc := range r.reCh {
+				if rc.name == name && rc.trailingSlash == trailingSlash {
+					return rc.node.place(path[len(k):], constraints)
+				}
+			}
+
+			node := &router{pn: name}
+			r.reCh = append(r.reCh, &regexChild{
+				name:          name,
+				trailingSlash: trailingSlash,
+				re:            re,
+				node:          node,
+			})
+
+			return node.place(path[len(k):], constraints)
+		}
+
+		wk := "*"
+		if trailingSlash {
+			wk = "*/"
+		}
+
+		ch := r.ch[wk]
+		if ch == nil {
+			ch = &router{}
+			r.ch[wk] = ch
+		}
+		ch.pn = name
+
+		return ch.place(path[len(k):], constraints)
+	}
+
 	ch := r.ch[k]
 	if ch == nil {
 		ch = &router{}
 		r.ch[k] = ch
 	}
 
-	return ch.place(path[len(k):])
+	return ch.place(path[len(k):], constraints)
 }
 
-func (r *router) find(path string, names *[]string) *router {
+func (r *router) find(path string, names *[]string, params *map[string]string) *router {
 	if path == "" {
 		return r
 	}
@@ -103,37 +311,179 @@ func (r *router) find(path string, names *[]string) *router {
 	// Check for a child under that path component.
 	if c := r.ch[k]; c != nil {
 		// If we find a child, continue our search with the rest of the path.
-		if h := c.find(path[len(k):], names); h != nil {
+		if h := c.find(path[len(k):], names, params); h != nil {
 			if h.rt != nil {
 				return h
 			}
 		}
 	}
 
+	trailingSlash := k[len(k)-1] == '/'
+	v := strings.TrimRight(k, "/")
+
+	// Try any regex-constrained children before falling back to the
+	// unconstrained wildcard, in the order they were registered.
+	for _, rc := range r.reCh {
+		if rc.trailingSlash != trailingSlash || !rc.re.MatchString(v) {
+			continue
+		}
+
+		n := len(*names)
+		*names = append(*names, v)
+		if rc.node.pn != "" {
+			if *params == nil {
+				*params = map[string]string{}
+			}
+			(*params)[rc.node.pn] = v
+		}
+		if h := rc.node.find(path[len(k):], names, params); h != nil && h.rt != nil {
+			return h
+		}
+		*names = (*names)[:n]
+		if rc.node.pn != "" {
+			delete(*params, rc.node.pn)
+		}
+	}
+
 	// Now we check if a wildcard node is registered. There are two wildcard types
 	// "*" and "*/".
 	w := "*"
-	if k[len(k)-1] == '/' {
+	if trailingSlash {
 		w = "*/"
 	}
 
 	if c := r.ch[w]; c != nil {
-		*names = append(*names, strings.TrimRight(k, "/"))
-		if h := c.find(path[len(k):], names); h != nil {
+		n := len(*names)
+		*names = append(*names, v)
+		if c.pn != "" {
+			if *params == nil {
+				*params = map[string]string{}
+			}
+			(*params)[c.pn] = v
+		}
+		if h := c.find(path[len(k):], names, params); h != nil {
 			if h.rt != nil {
 				return h
 			}
 		}
+		*names = (*names)[:n]
+		if c.pn != "" {
+			delete(*params, c.pn)
+		}
+	}
+
+	// Finally, a "**" catch-all claims the entire remaining path, slashes
+	// included, as a single name.
+	if c := r.ch["**"]; c != nil && c.rt != nil {
+		*names = append(*names, path)
+		return c
 	}
 
 	return nil
 }
 
-func (r *router) set(verb Verb, h Handler) {
+// CleanPath returns the canonical form of p: repeated slashes are collapsed,
+// "." segments are dropped, and ".." segments are resolved against the
+// preceding segment (a leading ".." at the root is simply dropped). A
+// trailing slash is preserved if present in p.
+func CleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	trailingSlash := len(p) > 1 && p[len(p)-1] == '/'
+
+	segs := strings.Split(p, "/")
+	out := segs[:0]
+	for _, s := range segs {
+		switch s {
+		case "", ".":
+			// collapses repeated slashes and drops "." segments
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+
+	cleaned := "/" + strings.Join(out, "/")
+	if trailingSlash && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// redirectPath reports the canonical path req should be redirected to, if
+// the router is configured (via rcp/rts) to do so and a route actually
+// exists at that canonical path.
+func (r *router) redirectPath(path string) (string, bool) {
+	if r.rcp {
+		if cleaned := CleanPath(path); cleaned != path {
+			var names []string
+			var params map[string]string
+			if h := r.find(cleaned[1:], &names, &params); h != nil && h.rt != nil {
+				return cleaned, true
+			}
+		}
+	}
+
+	if r.rts {
+		alt := strings.TrimSuffix(path, "/")
+		if alt == path {
+			alt = path + "/"
+		}
+
+		if alt != "" && alt != path {
+			var names []string
+			var params map[string]string
+			if h := r.find(alt[1:], &names, &params); h != nil && h.rt != nil {
+				return alt, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func (r *router) set(verb Verb, h Handler, mw []Middleware, pattern string) {
 	if r.rt == nil {
 		r.rt = &route{}
 	}
 	r.rt.vb[verb] = h
+	r.rt.mw[verb] = mw
+	r.rt.pattern = pattern
+}
+
+// Walk visits every verb/pattern registered on r, depth-first, stopping
+// and returning fn's error if it returns one. A node's routes are visited
+// before its children's; the order among sibling nodes is not defined.
+func (r *router) Walk(fn func(Route) error) error {
+	if r.rt != nil {
+		for i, h := range r.rt.vb {
+			if h == nil {
+				continue
+			}
+			if err := fn(Route{Verb: Verb(i), Pattern: r.rt.pattern}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range r.ch {
+		if err := c.Walk(fn); err != nil {
+			return err
+		}
+	}
+
+	for _, rc := range r.reCh {
+		if err := rc.node.Walk(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // ServeHTTP handles the HTTP request.
@@ -147,45 +497,181 @@ func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var names []string
+	var params map[string]string
 
-	t := r.find(req.URL.Path[1:], &names)
+	t := r.find(req.URL.Path[1:], &names, &params)
 	if t == nil || t.rt == nil {
+		if p, ok := r.redirectPath(req.URL.Path); ok {
+			if q := req.URL.RawQuery; q != "" {
+				p += "?" + q
+			}
+			http.Redirect(w, req, p, http.StatusMovedPermanently)
+			return
+		}
 		http.NotFound(w, req)
 		return
 	}
 
 	if h := t.rt.vb[v]; h != nil {
+		if params != nil {
+			req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+		}
 		h(w, req, names)
 		return
 	}
 
+	allow := t.rt.allow()
+
+	if v == Options && r.ao {
+		if allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.sah && allow != "" {
+		w.Header().Set("Allow", allow)
+	}
+
 	http.Error(w,
 		http.StatusText(http.StatusMethodNotAllowed),
 		http.StatusMethodNotAllowed)
 }
 
+// builder implements Builder. A builder and every Builder derived from it via
+// Group share the same underlying trie (root), so routes registered through
+// any of them end up in the same router.
+type builder struct {
+	root   *router
+	prefix string
+	mw     []Middleware
+}
+
 // Handle registers a verb/route in the router.
-func (r *router) Handle(verb Verb, path string, h Handler) {
-	r.place(path[1:]).set(verb, h)
+func (b *builder) Handle(verb Verb, path string, h Handler) {
+	n := b.root.place(b.fullPath(path), b.root.constraints)
+	n.set(verb, h, b.mwStack(), b.prefix+path)
 }
 
 // HandleAll registers a route on all verbs in the router.
-func (r *router) HandleAll(path string, h Handler) {
-	n := r.place(path[1:])
+func (b *builder) HandleAll(path string, h Handler) {
+	n := b.root.place(b.fullPath(path), b.root.constraints)
+	mw := b.mwStack()
+	pattern := b.prefix + path
 	for i := 0; i < int(unknownVerb); i++ {
-		n.set(Verb(i), h)
+		n.set(Verb(i), h, mw, pattern)
 	}
 }
 
-// Build takes a snapshot of the contents in builder and converts it to a
-// http.Handler for serving requests. It also clears the content in the Builder.
-func (r *router) Build() http.Handler {
-	n := *r
-	*r = router{}
+// Use appends middleware to this builder's stack.
+func (b *builder) Use(mw ...Middleware) {
+	b.mw = append(b.mw, mw...)
+}
+
+// Group creates a scoped Builder with prefix prepended to every route it
+// registers, inheriting the current middleware stack.
+func (b *builder) Group(prefix string, fn func(Builder)) {
+	fn(&builder{
+		root:   b.root,
+		prefix: b.prefix + prefix,
+		mw:     b.mwStack(),
+	})
+}
+
+// RedirectCleanPath enables or disables redirecting to the cleaned form of a
+// path that doesn't otherwise match a route. It applies to the whole router,
+// not just this builder's scope.
+func (b *builder) RedirectCleanPath(v bool) {
+	b.root.rcp = v
+}
+
+// RedirectTrailingSlash enables or disables redirecting to a path with its
+// trailing slash added or removed when that form matches a route. It applies
+// to the whole router, not just this builder's scope.
+func (b *builder) RedirectTrailingSlash(v bool) {
+	b.root.rts = v
+}
+
+// AddRegex constrains name to pattern. It applies to the whole router, not
+// just this builder's scope.
+func (b *builder) AddRegex(name, pattern string) {
+	b.root.addConstraint(name, pattern)
+}
+
+// AutoOptions enables or disables auto-handling OPTIONS requests with a 204
+// and a computed Allow header. It applies to the whole router, not just this
+// builder's scope.
+func (b *builder) AutoOptions(v bool) {
+	b.root.ao = v
+}
+
+// SendAllowHeader enables or disables populating the Allow header on 405
+// responses. It applies to the whole router, not just this builder's scope.
+func (b *builder) SendAllowHeader(v bool) {
+	b.root.sah = v
+}
+
+// Build takes a snapshot of the contents in the builder and converts it to a
+// http.Handler for serving requests. It also clears the content in the
+// Builder. Every registered Handler is wrapped with the middleware stack
+// captured for it at registration time, so serving itself stays lock-free.
+func (b *builder) Build() http.Handler {
+	wrap(b.root)
+
+	n := *b.root
+	*b.root = router{}
 	return &n
 }
 
+func (b *builder) fullPath(path string) string {
+	return (b.prefix + path)[1:]
+}
+
+// mwStack returns a copy of b's current middleware stack, so later calls to
+// Use don't retroactively affect routes already registered.
+func (b *builder) mwStack() []Middleware {
+	return append([]Middleware(nil), b.mw...)
+}
+
+// wrap walks the route tree rooted at r, composing each registered Handler
+// with the middleware stack captured for it at registration time.
+func wrap(r *router) {
+	if r.rt != nil {
+		for i, h := range r.rt.vb {
+			if h == nil {
+				continue
+			}
+			mw := r.rt.mw[i]
+			for j := len(mw) - 1; j >= 0; j-- {
+				h = mw[j](h)
+			}
+			r.rt.vb[i] = h
+			r.rt.mw[i] = nil
+		}
+	}
+
+	for _, c := range r.ch {
+		wrap(c)
+	}
+	for _, rc := range r.reCh {
+		wrap(rc.node)
+	}
+}
+
+// Built-in regex constraints, registered on every router so routes can use
+// them without an explicit AddRegex call.
+const (
+	reInt  = `[0-9]+`
+	reUUID = `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`
+	reSlug = `[a-z0-9]+(?:-[a-z0-9]+)*`
+)
+
 // New creates a Builder.
 func New() Builder {
-	return &router{}
+	root := &router{}
+	root.addConstraint("int", reInt)
+	root.addConstraint("uuid", reUUID)
+	root.addConstraint("slug", reSlug)
+	return &builder{root: root}
 }
@@ -217,3 +217,380 @@ func TestNames(t *testing.T) {
 	}
 
 }
+
+func TestNamedParams(t *testing.T) {
+	r := New()
+
+	var got map[string]string
+	capture := func(w http.ResponseWriter, req *http.Request, names []string) {
+		got = map[string]string{
+			"id":  Param(req, "id"),
+			"pid": Param(req, "pid"),
+		}
+	}
+
+	r.Handle(Get, "/users/:id", capture)
+	r.Handle(Get, "/users/:id/posts/:pid", capture)
+
+	h := r.Build()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/42")
+	if got["id"] != "42" || got["pid"] != "" {
+		t.Fatalf("expected id=42, pid=\"\", got %v", got)
+	}
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/42/posts/7")
+	if got["id"] != "42" || got["pid"] != "7" {
+		t.Fatalf("expected id=42, pid=7, got %v", got)
+	}
+}
+
+func tagMiddleware(tag string, order *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, names []string) {
+			*order = append(*order, tag)
+			next(w, r, names)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	r := New()
+
+	var order []string
+
+	r.Use(tagMiddleware("outer", &order))
+	r.Handle(Get, "/a", func(w http.ResponseWriter, req *http.Request, names []string) {
+		order = append(order, "/a")
+	})
+
+	r.Group("/g", func(b Builder) {
+		b.Use(tagMiddleware("inner", &order))
+		b.Handle(Get, "/b", func(w http.ResponseWriter, req *http.Request, names []string) {
+			order = append(order, "/g/b")
+		})
+	})
+
+	h := r.Build()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/a")
+	if !stringArraysEqual([]string{"outer", "/a"}, order) {
+		t.Fatalf("expected [outer /a], got %v", order)
+	}
+	order = nil
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/g/b")
+	if !stringArraysEqual([]string{"outer", "inner", "/g/b"}, order) {
+		t.Fatalf("expected [outer inner /g/b], got %v", order)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"/a/b", "/a/b"},
+		{"/a//b", "/a/b"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"/../a", "/a"},
+		{"/a/b/", "/a/b/"},
+		{"", "/"},
+	}
+
+	for _, test := range tests {
+		if got := CleanPath(test.in); got != test.out {
+			t.Fatalf("CleanPath(%q) = %q, want %q", test.in, got, test.out)
+		}
+	}
+}
+
+func redirectTo(t *testing.T, h http.Handler, path string) (int, string) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http:%s", path), nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res := respWriter{header: http.Header(map[string][]string{})}
+	h.ServeHTTP(&res, req)
+
+	status := res.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return status, res.header.Get("Location")
+}
+
+func TestRedirects(t *testing.T) {
+	r := New()
+	rec := handler{tags: map[string]bool{}}
+
+	r.RedirectCleanPath(true)
+	r.RedirectTrailingSlash(true)
+	r.Handle(Get, "/a/b", rec.handler("/a/b"))
+	r.Handle(Get, "/a/c/", rec.handler("/a/c/"))
+
+	h := r.Build()
+
+	if status, loc := redirectTo(t, h, "/a//b"); status != http.StatusMovedPermanently || loc != "/a/b" {
+		t.Fatalf("expected 301 to /a/b, got %d %q", status, loc)
+	}
+
+	if status, loc := redirectTo(t, h, "/a/c"); status != http.StatusMovedPermanently || loc != "/a/c/" {
+		t.Fatalf("expected 301 to /a/c/, got %d %q", status, loc)
+	}
+
+	if status, loc := redirectTo(t, h, "/a/b/"); status != http.StatusMovedPermanently || loc != "/a/b" {
+		t.Fatalf("expected 301 to /a/b, got %d %q", status, loc)
+	}
+
+	if status, _ := redirectTo(t, h, "/a/d"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for /a/d, got %d", status)
+	}
+}
+
+func TestRegexConstraints(t *testing.T) {
+	r := New()
+	r.AddRegex(":id", "[0-9]+")
+
+	var idGot, slugGot, nameGot string
+	r.Handle(Get, "/users/:id", func(w http.ResponseWriter, req *http.Request, names []string) {
+		idGot = Param(req, "id")
+	})
+	r.Handle(Get, "/users/:slug", func(w http.ResponseWriter, req *http.Request, names []string) {
+		slugGot = Param(req, "slug")
+	})
+	r.Handle(Get, "/users/:name", func(w http.ResponseWriter, req *http.Request, names []string) {
+		nameGot = Param(req, "name")
+	})
+
+	h := r.Build()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/42")
+	if idGot != "42" {
+		t.Fatalf("expected id=42, got %q", idGot)
+	}
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/hello-world")
+	if slugGot != "hello-world" {
+		t.Fatalf("expected slug=hello-world, got %q", slugGot)
+	}
+
+	// A constraint must match the whole segment, not just a substring of it.
+	// "42abc" doesn't satisfy :id's "[0-9]+", but it does happen to satisfy
+	// the built-in slug pattern, so it's handled by :slug rather than :id.
+	idGot, slugGot = "", ""
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/42abc")
+	if idGot != "" || slugGot != "42abc" {
+		t.Fatalf("expected slug=42abc, got id=%q slug=%q", idGot, slugGot)
+	}
+
+	// "Hello" satisfies neither :id's digits-only pattern nor the built-in
+	// slug pattern (which is lowercase-only), so it falls through to the
+	// genuinely unconstrained :name wildcard.
+	idGot, slugGot, nameGot = "", "", ""
+	expectDispatch(t, http.StatusOK, h, "GET", "/users/Hello")
+	if idGot != "" || slugGot != "" || nameGot != "Hello" {
+		t.Fatalf("expected fallback to name=Hello, got id=%q slug=%q name=%q", idGot, slugGot, nameGot)
+	}
+}
+
+func TestRegexConstraintParamRollback(t *testing.T) {
+	r := New()
+	r.AddRegex(":id", "[0-9]+")
+
+	var idGot, slugGot string
+	r.Handle(Get, "/a/:id/x", func(w http.ResponseWriter, req *http.Request, names []string) {
+		idGot = Param(req, "id")
+	})
+	r.Handle(Get, "/a/:slug/y", func(w http.ResponseWriter, req *http.Request, names []string) {
+		idGot = Param(req, "id")
+		slugGot = Param(req, "slug")
+	})
+
+	h := r.Build()
+
+	// "42" satisfies :id, but the deeper "/x" segment doesn't match, so the
+	// failed descent must not leak id="42" into the :slug route that
+	// ultimately handles the request.
+	expectDispatch(t, http.StatusOK, h, "GET", "/a/42/y")
+	if idGot != "" {
+		t.Fatalf("expected id to be empty, got %q", idGot)
+	}
+	if slugGot != "42" {
+		t.Fatalf("expected slug=42, got %q", slugGot)
+	}
+}
+
+func TestBuiltinRegexConstraints(t *testing.T) {
+	r := New()
+
+	var intGot string
+	r.Handle(Get, "/items/:int", func(w http.ResponseWriter, req *http.Request, names []string) {
+		intGot = Param(req, "int")
+	})
+
+	h := r.Build()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/items/7")
+	if intGot != "7" {
+		t.Fatalf("expected int=7, got %q", intGot)
+	}
+
+	expectDispatch(t, http.StatusNotFound, h, "GET", "/items/seven")
+	expectDispatch(t, http.StatusNotFound, h, "GET", "/items/7x")
+	expectDispatch(t, http.StatusNotFound, h, "GET", "/items/12a3")
+}
+
+func TestCatchAll(t *testing.T) {
+	r := New()
+
+	rec := handler{tags: map[string]bool{}}
+	r.Handle(Get, "/files/**", rec.handler("/files/**"))
+
+	h := r.Build()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/files/a/b/c.txt")
+	if !rec.taggedWith("/files/**") {
+		t.Fatalf("expected only /files/** to be called: %v", rec)
+	}
+	if !stringArraysEqual([]string{"a/b/c.txt"}, rec.lastNames()) {
+		t.Fatalf("expected names [a/b/c.txt], got %v", rec.lastNames())
+	}
+	rec.clear()
+
+	expectDispatch(t, http.StatusOK, h, "GET", "/files/a.txt")
+	if !stringArraysEqual([]string{"a.txt"}, rec.lastNames()) {
+		t.Fatalf("expected names [a.txt], got %v", rec.lastNames())
+	}
+}
+
+func TestCatchAllSiblingOfWildcard(t *testing.T) {
+	r := New()
+
+	rec := handler{tags: map[string]bool{}}
+	r.Handle(Get, "/a/*/b", rec.handler("/a/*/b"))
+	r.Handle(Get, "/a/**", rec.handler("/a/**"))
+
+	h := r.Build()
+
+	// The failed descent into "/a/*/b" must not leave a stale name behind
+	// for "/a/**" to pick up.
+	expectDispatch(t, http.StatusOK, h, "GET", "/a/x/c")
+	if !rec.taggedWith("/a/**") {
+		t.Fatalf("expected /a/** to be called: %v", rec)
+	}
+	if !stringArraysEqual([]string{"x/c"}, rec.lastNames()) {
+		t.Fatalf("expected names [x/c], got %v", rec.lastNames())
+	}
+}
+
+func TestCatchAllMustBeFinalSegment(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected Handle to panic for \"**\" followed by more segments")
+		}
+	}()
+
+	r := New()
+	r.Handle(Get, "/files/**/extra", func(http.ResponseWriter, *http.Request, []string) {})
+}
+
+func dispatchAllow(t *testing.T, h http.Handler, verb, path string) (int, string) {
+	req, err := http.NewRequest(verb, fmt.Sprintf("http:%s", path), nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res := respWriter{header: http.Header(map[string][]string{})}
+	h.ServeHTTP(&res, req)
+
+	status := res.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return status, res.header.Get("Allow")
+}
+
+func TestSendAllowHeader(t *testing.T) {
+	r := New()
+	r.SendAllowHeader(true)
+
+	rec := handler{tags: map[string]bool{}}
+	r.Handle(Get, "/a", rec.handler("GET /a"))
+	r.Handle(Post, "/a", rec.handler("POST /a"))
+
+	h := r.Build()
+
+	status, allow := dispatchAllow(t, h, "DELETE", "/a")
+	if status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", status)
+	}
+	if allow != "GET, POST" {
+		t.Fatalf("expected Allow \"GET, POST\", got %q", allow)
+	}
+}
+
+func TestAutoOptions(t *testing.T) {
+	r := New()
+	r.AutoOptions(true)
+
+	rec := handler{tags: map[string]bool{}}
+	r.Handle(Get, "/a", rec.handler("GET /a"))
+	r.Handle(Post, "/a", rec.handler("POST /a"))
+
+	var explicit bool
+	r.Handle(Options, "/b", func(w http.ResponseWriter, req *http.Request, names []string) {
+		explicit = true
+	})
+
+	h := r.Build()
+
+	status, allow := dispatchAllow(t, h, "OPTIONS", "/a")
+	if status != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", status)
+	}
+	if allow != "GET, POST" {
+		t.Fatalf("expected Allow \"GET, POST\", got %q", allow)
+	}
+
+	if status, _ := dispatchAllow(t, h, "OPTIONS", "/b"); status != http.StatusOK {
+		t.Fatalf("expected 200 from the explicit OPTIONS handler, got %d", status)
+	}
+	if !explicit {
+		t.Fatalf("expected the explicit OPTIONS handler to run")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	r := New()
+
+	noop := func(http.ResponseWriter, *http.Request, []string) {}
+	r.Handle(Get, "/a", noop)
+	r.Handle(Post, "/a", noop)
+	r.Group("/g", func(b Builder) {
+		b.Handle(Get, "/b/:id", noop)
+	})
+
+	h := r.Build()
+
+	routes, ok := h.(Routes)
+	if !ok {
+		t.Fatalf("expected Build to return a Routes")
+	}
+
+	got := map[string]bool{}
+	if err := routes.Walk(func(rt Route) error {
+		got[fmt.Sprintf("%s %s", verbNames[rt.Verb], rt.Pattern)] = true
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error from Walk: %v", err)
+	}
+
+	want := []string{"GET /a", "POST /a", "GET /g/b/:id"}
+	for _, w := range want {
+		if !got[w] {
+			t.Fatalf("expected Walk to report %q, got %v", w, got)
+		}
+	}
+}